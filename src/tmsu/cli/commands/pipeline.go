@@ -0,0 +1,248 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"tmsu/log"
+	"tmsu/storage"
+	"tmsu/storage/database"
+)
+
+// writeBatchSize is the number of pending writes the DB writer will
+// accumulate before committing them as a single transaction.
+const writeBatchSize = 100
+
+// sizeCandidate is a file discovered while walking the PATHs given to
+// 'repair', destined for the pathsBySize map used for move detection.
+type sizeCandidate struct {
+	path string
+	size int64
+}
+
+// crawl walks the given root paths concurrently and streams the non-empty
+// files it finds onto the returned channel; directories and empty files are
+// left out. The number of directories being
+// read at any one time is bounded by command.jobs(), the same limit applied
+// to the fingerprint worker pool, so a wide tree does not open thousands of
+// simultaneous stats and reads against the backend: on a remote filesystem
+// such as SFTP or S3 that would otherwise exhaust file descriptors locally
+// or trip a server's rate limiting. The channel is closed once every
+// directory has been visited.
+func (command RepairCommand) crawl(roots []string) <-chan sizeCandidate {
+	candidates := make(chan sizeCandidate, 4*command.jobs())
+	sem := make(chan struct{}, command.jobs())
+
+	var wg sync.WaitGroup
+
+	var walk func(path string)
+	walk = func(path string) {
+		defer wg.Done()
+
+		sem <- struct{}{}
+		defer func() { <-sem }()
+
+		absPath, err := command.filesystem.Abs(path)
+		if err != nil {
+			log.Warnf("'%v': %v", path, err)
+			return
+		}
+
+		info, err := command.filesystem.Stat(absPath)
+		if err != nil {
+			if !os.IsPermission(err) {
+				log.Warnf("'%v': %v", absPath, err)
+			}
+			return
+		}
+
+		if !info.IsDir() {
+			if info.Size() > 0 {
+				candidates <- sizeCandidate{absPath, info.Size()}
+			}
+			return
+		}
+
+		infos, err := command.filesystem.ReadDir(absPath)
+		if err != nil {
+			log.Warnf("'%v': %v", absPath, err)
+			return
+		}
+
+		for _, childInfo := range infos {
+			wg.Add(1)
+			go walk(command.filesystem.Join(absPath, childInfo.Name()))
+		}
+	}
+
+	for _, root := range roots {
+		wg.Add(1)
+		go walk(root)
+	}
+
+	go func() {
+		wg.Wait()
+		close(candidates)
+	}()
+
+	return candidates
+}
+
+// buildFileSystemMap runs the concurrent crawl and collects its results
+// into the pathsBySize map consumed by move detection. Fingerprints for
+// these candidates are not computed here: processMissingEntry fetches them
+// lazily via the shared cache, which keeps a candidate's digest once
+// computed no matter how many missing entries of a given size it is
+// compared against. The cache does not coordinate concurrent callers, so two
+// workers that reach the same uncached candidate at the same moment each
+// hash it.
+func (command RepairCommand) buildFileSystemMap(paths []string) (map[int64][]string, error) {
+	if command.verbose {
+		fmt.Printf("Building map of files by size.\n")
+	}
+
+	pathsBySize := make(map[int64][]string)
+
+	for candidate := range command.crawl(paths) {
+		pathsBySize[candidate.size] = append(pathsBySize[candidate.size], candidate.path)
+	}
+
+	if command.verbose {
+		fmt.Printf("Finished building map of files by size.\n")
+	}
+
+	return pathsBySize, nil
+}
+
+// writeOp is a single database mutation produced by a fingerprint worker,
+// to be applied by the single writer goroutine so that all writes happen
+// on one connection.
+type writeOp func(store *storage.Storage) error
+
+// runWriter drains ops, applying them to store in batches of writeBatchSize
+// inside a transaction each, so a repair of many thousands of files does
+// not pay for a transaction per file. It returns the first error
+// encountered. Once an error has occurred, runWriter keeps draining (and
+// discarding) ops until the channel is closed rather than returning
+// immediately: the fingerprint workers feeding ops block on a full channel,
+// so abandoning the drain here would deadlock fingerprintPool and leave
+// Exec's read of errs waiting forever.
+func runWriter(store *storage.Storage, ops <-chan writeOp) error {
+	pending := 0
+	var firstErr error
+
+	begin := func() error {
+		if pending == 0 {
+			return store.Begin()
+		}
+		return nil
+	}
+
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		pending = 0
+		return store.Commit()
+	}
+
+	for op := range ops {
+		if firstErr != nil {
+			continue
+		}
+
+		if err := begin(); err != nil {
+			firstErr = err
+			continue
+		}
+
+		if err := op(store); err != nil {
+			store.Rollback()
+			pending = 0
+			firstErr = err
+			continue
+		}
+
+		pending++
+
+		if pending >= writeBatchSize {
+			if err := flush(); err != nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return flush()
+}
+
+// fingerprintPool runs task for each entry received on entries using
+// command.jobs() concurrent workers, collecting the writeOps it produces
+// onto a single channel for the writer goroutine to apply. The returned
+// channels are both closed once every worker has finished.
+func (command RepairCommand) fingerprintPool(entries <-chan *database.File, task func(*database.File) (writeOp, error)) (<-chan writeOp, <-chan error) {
+	ops := make(chan writeOp, writeBatchSize)
+	errs := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+
+	reportErr := func(err error) {
+		once.Do(func() { errs <- err })
+	}
+
+	for i := 0; i < command.jobs(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for entry := range entries {
+				op, err := task(entry)
+				if err != nil {
+					reportErr(err)
+					continue
+				}
+				if op != nil {
+					ops <- op
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ops)
+		close(errs)
+	}()
+
+	return ops, errs
+}
+
+// jobs is the number of concurrent fingerprint workers to run, defaulting
+// to one per CPU when --jobs was not specified.
+func (command RepairCommand) jobs() int {
+	if command.jobCount > 0 {
+		return command.jobCount
+	}
+	return defaultJobs()
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks the running totals for a repair pass and prints them
+// periodically so the user has some indication of how far through a large
+// tree the command has got. It is updated concurrently by the fingerprint
+// workers so all counters are accessed atomically.
+type progress struct {
+	filesScanned int64
+	bytesHashed  int64
+	totalFiles   int64
+
+	start time.Time
+	stop  chan struct{}
+}
+
+func newProgress(totalFiles int64) *progress {
+	return &progress{totalFiles: totalFiles, start: time.Now(), stop: make(chan struct{})}
+}
+
+func (p *progress) addFile(size int64) {
+	atomic.AddInt64(&p.filesScanned, 1)
+	atomic.AddInt64(&p.bytesHashed, size)
+}
+
+// Start begins printing a compact, single-line progress report every
+// quarter second. It is intended for use on an interactive TTY; verbose
+// mode prints a line per file instead and does not use this ticker.
+func (p *progress) Start() {
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *progress) Stop() {
+	close(p.stop)
+	fmt.Print("\r\033[K")
+}
+
+func (p *progress) print() {
+	scanned := atomic.LoadInt64(&p.filesScanned)
+	bytes := atomic.LoadInt64(&p.bytesHashed)
+
+	eta := ""
+	if scanned > 0 && p.totalFiles > scanned {
+		elapsed := time.Since(p.start)
+		perFile := elapsed / time.Duration(scanned)
+		remaining := perFile * time.Duration(p.totalFiles-scanned)
+		eta = fmt.Sprintf(", eta %v", remaining.Round(time.Second))
+	}
+
+	fmt.Printf("\r\033[K%v/%v files scanned, %v hashed%v", scanned, p.totalFiles, formatBytes(bytes), eta)
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+
+	if bytes < unit {
+		return fmt.Sprintf("%vB", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
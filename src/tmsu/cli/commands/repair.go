@@ -21,19 +21,98 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"tmsu/cli"
-	"tmsu/fingerprint"
+	"tmsu/fingerprint/cache"
+	"tmsu/fs"
 	"tmsu/log"
 	"tmsu/storage"
 	"tmsu/storage/database"
 )
 
+// cachePath is the location, relative to the database directory, of the
+// persistent fingerprint cache shared by 'repair' and 'watch'.
+const cachePath = "fingerprints.cache"
+
+func defaultJobs() int {
+	return runtime.NumCPU()
+}
+
 //TODO add missing implicit taggings
 //TODO delete implicitly tagged files that are missing
 //TODO handle directory being replaced by a file (currently causes error)
 
 type RepairCommand struct {
-	verbose bool
+	verbose    bool
+	jobCount   int
+	filesystem fs.Filesystem
+}
+
+// registryPath is the location, relative to the database directory, of the
+// record of which Filesystem backend each tagged path was last repaired or
+// watched against.
+const registryPath = "filesystem.registry.json"
+
+// resolveFilesystem picks the Filesystem backend for this repair run from
+// the PATHs given on the command line and rewrites args to the paths
+// relative to that backend. Repair operates against a single backend per
+// invocation: mixing, say, a local path and an "sftp://" URI, or two
+// different SFTP hosts, in the same run is rejected rather than guessed at.
+//
+// A bare path with no "scheme://" prefix is looked up in registry first: if
+// it was previously resolved against a remote backend, that backend is
+// reused rather than defaulting to the local filesystem, so a path tagged
+// via "sftp://" or "s3://" need not have its URI respecified on every run.
+func resolveFilesystem(registry *fs.PathRegistry, args []string) (fs.Filesystem, []string, error) {
+	if len(args) == 0 {
+		return fs.Basic{}, args, nil
+	}
+
+	relArgs := make([]string, len(args))
+
+	filesystem, relPath, err := resolveArg(registry, args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	relArgs[0] = relPath
+
+	for i, arg := range args[1:] {
+		argFilesystem, relPath, err := resolveArg(registry, arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if argFilesystem.Type() != filesystem.Type() || argFilesystem.URI("/") != filesystem.URI("/") {
+			return nil, nil, fmt.Errorf("'%v': all PATHs must be on the same filesystem", arg)
+		}
+		relArgs[i+1] = relPath
+	}
+
+	for _, relArg := range relArgs {
+		if err := registry.Record(relArg, filesystem); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return filesystem, relArgs, nil
+}
+
+// resolveArg resolves a single PATH argument to a Filesystem, consulting
+// registry for a bare path before falling back to fs.New's default of the
+// local filesystem.
+func resolveArg(registry *fs.PathRegistry, arg string) (fs.Filesystem, string, error) {
+	if strings.Contains(arg, "://") {
+		return fs.New(arg)
+	}
+
+	if filesystem, relPath, found, err := registry.Lookup(arg); err != nil {
+		return nil, "", err
+	} else if found {
+		return filesystem, relPath, nil
+	}
+
+	return fs.New(arg)
 }
 
 func (RepairCommand) Name() cli.CommandName {
@@ -72,25 +151,53 @@ be identified where no PATHs are specified.)`
 }
 
 func (RepairCommand) Options() cli.Options {
-	return cli.Options{}
+	return cli.Options{
+		cli.Option{LongName: "--jobs", ShortName: "-j", Description: "number of fingerprinting workers to run in parallel (default: number of CPUs)", HasArgument: true, ArgumentName: "JOBS"},
+	}
 }
 
 func (command RepairCommand) Exec(options cli.Options, args []string) error {
 	command.verbose = cli.HasOption(options, "--verbose")
 
+	if jobsOption, found := cli.GetOption(options, "--jobs"); found {
+		jobCount, err := strconv.Atoi(jobsOption.Argument)
+		if err != nil {
+			return fmt.Errorf("invalid value for --jobs: '%v'", jobsOption.Argument)
+		}
+		command.jobCount = jobCount
+	}
+
+	store, err := storage.Open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	registry, err := fs.OpenPathRegistry(filepath.Join(store.Db.Dir(), registryPath))
+	if err != nil {
+		return err
+	}
+
+	filesystem, args, err := resolveFilesystem(registry, args)
+	if err != nil {
+		return err
+	}
+	command.filesystem = filesystem
+
 	pathsBySize, err := command.buildFileSystemMap(args)
 	if err != nil {
 		return err
 	}
 
-	store, err := storage.Open()
+	fingerprints, err := cache.Open(command.filesystem, filepath.Join(store.Db.Dir(), cachePath))
 	if err != nil {
 		return err
 	}
-	defer store.Close()
+	defer fingerprints.Close()
 
+	var allEntries []*database.File
 	for _, path := range args {
-		absPath, err := filepath.Abs(path)
+		absPath, err := command.filesystem.Abs(path)
 		if err != nil {
 			return err
 		}
@@ -100,57 +207,98 @@ func (command RepairCommand) Exec(options cli.Options, args []string) error {
 			return err
 		}
 
-		for _, entry := range entries {
-			err := command.checkEntry(entry, store, pathsBySize)
-			if err != nil {
-				return err
-			}
+		allEntries = append(allEntries, entries...)
+	}
+
+	reporter := newProgress(int64(len(allEntries)))
+	if !command.verbose {
+		reporter.Start()
+	}
+
+	entryChan := make(chan *database.File, command.jobs())
+	go func() {
+		defer close(entryChan)
+		for _, entry := range allEntries {
+			entryChan <- entry
 		}
+	}()
+
+	ops, errs := command.fingerprintPool(entryChan, func(entry *database.File) (writeOp, error) {
+		op, err := command.checkEntry(entry, fingerprints, pathsBySize, reporter)
+		return op, err
+	})
+
+	writerErr := runWriter(store, ops)
+
+	if !command.verbose {
+		reporter.Stop()
 	}
 
-	return nil
+	if poolErr := <-errs; poolErr != nil {
+		return poolErr
+	}
+
+	return writerErr
 }
 
-func (command RepairCommand) checkEntry(entry *database.File, store *storage.Storage, pathsBySize map[int64][]string) error {
+// checkEntry examines a single database entry against the filesystem and
+// returns the writeOp, if any, needed to bring the database back in step.
+// It performs no I/O against the database itself so that it can run
+// concurrently across the fingerprint worker pool; all mutation happens
+// later, on the single writer goroutine.
+func (command RepairCommand) checkEntry(entry *database.File, fingerprints *cache.Cache, pathsBySize map[int64][]string, reporter *progress) (writeOp, error) {
 	if command.verbose {
 		fmt.Printf("'%v': checking.\n", entry.Path())
 	}
 
-	info, err := os.Stat(entry.Path())
+	info, err := command.filesystem.Stat(entry.Path())
 	if err != nil {
 		switch {
 		case os.IsNotExist(err):
-			err = command.processMissingEntry(entry, pathsBySize, store)
-			if err != nil {
-				return err
-			}
+			op, err := command.processMissingEntry(entry, fingerprints, pathsBySize)
+			reporter.addFile(entry.Size)
+			return op, err
 		case os.IsPermission(err):
 			log.Warnf("'%v': permission denied.", entry.Path())
 		default:
 			log.Warnf("'%v': %v", entry.Path(), err)
 		}
 
-		return nil
+		reporter.addFile(entry.Size)
+		return nil, nil
 	}
 	modTime := info.ModTime().UTC()
 	size := info.Size()
 
+	var op writeOp
+
 	if modTime.Unix() != entry.ModTimestamp.Unix() || size != entry.Size {
 		if command.verbose {
 			fmt.Printf("'%v': updating entry in database.\n", entry.Path())
 		}
 
-		fingerprint, err := fingerprint.Create(entry.Path())
-		if err != nil {
-			return err
+		// size or modification time has changed so the cached digest, if
+		// any, is stale: recompute it rather than trusting the cache.
+		if err := fingerprints.Invalidate(entry.Path()); err != nil {
+			return nil, err
 		}
 
-		err = store.UpdateFile(entry.Id, entry.Path(), fingerprint, modTime, size)
+		fingerprint, err := fingerprints.Checksum(entry.Path())
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		fmt.Printf("'%v': modified.\n", entry.Path())
+		// printed only once the write has actually landed, on the writer
+		// goroutine: runWriter silently discards every op still pending
+		// after the first error, so printing here, before the op even
+		// runs, would claim entries were updated that never were.
+		op = func(store *storage.Storage) error {
+			if err := store.UpdateFile(entry.Id, entry.Path(), fingerprint, modTime, size); err != nil {
+				return err
+			}
+			fmt.Printf("'%v': modified.\n", entry.Path())
+			return nil
+		}
 	} else {
 		if command.verbose {
 			fmt.Printf("'%v': unchanged.\n", entry.Path())
@@ -158,36 +306,51 @@ func (command RepairCommand) checkEntry(entry *database.File, store *storage.Sto
 	}
 
 	if info.IsDir() {
-		tags, err := store.TagsByFileId(entry.Id, false)
+		// the recursive digest lets an unchanged subtree be skipped
+		// entirely: if every name, size and modification time from here
+		// down still matches what was cached, there can be no new files or
+		// missing implicit taggings beneath it worth looking for.
+		_, unchanged, err := fingerprints.ChecksumTree(entry.Path())
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		err = command.processDirectory(store, entry, tags)
-		if err != nil {
-			return err
+		if unchanged {
+			if command.verbose {
+				fmt.Printf("'%v': subtree unchanged, skipping.\n", entry.Path())
+			}
+		} else {
+			dirOp := op
+			op = func(store *storage.Storage) error {
+				if dirOp != nil {
+					if err := dirOp(store); err != nil {
+						return err
+					}
+				}
+
+				tags, err := store.TagsByFileId(entry.Id, false)
+				if err != nil {
+					return err
+				}
+
+				return command.processDirectory(store, entry, tags)
+			}
 		}
 	}
 
-	return nil
+	reporter.addFile(size)
+
+	return op, nil
 }
 
 func (command RepairCommand) processDirectory(store *storage.Storage, entry *database.File, tags database.Tags) error {
-	dir, err := os.Open(entry.Path())
+	infos, err := command.filesystem.ReadDir(entry.Path())
 	if err != nil {
 		return err
 	}
 
-	filenames, err := dir.Readdirnames(0)
-	if err != nil {
-		dir.Close()
-		return err
-	}
-
-	dir.Close()
-
-	for _, filename := range filenames {
-		childPath := filepath.Join(entry.Path(), filename)
+	for _, info := range infos {
+		childPath := command.filesystem.Join(entry.Path(), info.Name())
 
 		childFile, err := store.FileByPath(childPath)
 		if err != nil {
@@ -224,13 +387,13 @@ func (command RepairCommand) processDirectory(store *storage.Storage, entry *dat
 	return nil
 }
 
-func (command RepairCommand) processMissingEntry(entry *database.File, pathsBySize map[int64][]string, store *storage.Storage) error {
+func (command RepairCommand) processMissingEntry(entry *database.File, fingerprints *cache.Cache, pathsBySize map[int64][]string) (writeOp, error) {
 	if entry.Fingerprint == "" {
 		if command.verbose {
 			fmt.Printf("'%v': not searching for new location (no fingerprint).\n", entry.Path())
 		}
 
-		return nil
+		return nil, nil
 	}
 
 	if command.verbose {
@@ -240,9 +403,13 @@ func (command RepairCommand) processMissingEntry(entry *database.File, pathsBySi
 	paths, found := pathsBySize[entry.Size]
 	if found {
 		for _, path := range paths {
-			fingerprint, err := fingerprint.Create(path)
+			// the cache keeps a candidate's digest once computed, however
+			// many missing entries of the same size we are trying to match
+			// it against; two workers that reach the same uncached
+			// candidate at the same moment each hash it, though.
+			fingerprint, err := fingerprints.Checksum(path)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			if fingerprint == entry.Fingerprint {
@@ -250,93 +417,25 @@ func (command RepairCommand) processMissingEntry(entry *database.File, pathsBySi
 					fmt.Printf("'%v': file with same fingerprint found at '%v'\n", entry.Path(), path)
 				}
 
-				info, err := os.Stat(path)
+				info, err := command.filesystem.Stat(path)
 				if err != nil {
-					return err
+					return nil, err
 				}
 
-				err = store.UpdateFile(entry.Id, path, entry.Fingerprint, info.ModTime().UTC(), info.Size())
-				if err != nil {
-					return err
-				}
-
-				fmt.Printf("'%v': moved to '%v'.\n", entry.Path(), path)
-				return nil
+				// printed only once the write has actually landed, on the
+				// writer goroutine, for the same reason as in checkEntry.
+				modTime, size := info.ModTime().UTC(), info.Size()
+				return func(store *storage.Storage) error {
+					if err := store.UpdateFile(entry.Id, path, entry.Fingerprint, modTime, size); err != nil {
+						return err
+					}
+					fmt.Printf("'%v': moved to '%v'.\n", entry.Path(), path)
+					return nil
+				}, nil
 			}
 		}
 	}
 
 	log.Warnf("'%v': missing.", entry.Path())
-	return nil
-}
-
-func (command RepairCommand) buildFileSystemMap(paths []string) (map[int64][]string, error) {
-	if command.verbose {
-		fmt.Printf("Building map of files by size.\n")
-	}
-
-	pathsBySize := make(map[int64][]string)
-
-	for _, path := range paths {
-		err := command.buildFileSystemMapRecursive(path, pathsBySize)
-		if err != nil {
-			switch {
-			case os.IsPermission(err):
-				log.Warnf("'%v': permission denied.")
-				continue
-			}
-
-			return nil, err
-		}
-	}
-
-	if command.verbose {
-		fmt.Printf("Finished building map of files by size.\n")
-	}
-
-	return pathsBySize, nil
-}
-
-func (command RepairCommand) buildFileSystemMapRecursive(path string, pathsBySize map[int64][]string) error {
-	path, err := filepath.Abs(path)
-	if err != nil {
-		return err
-	}
-
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-
-	info, err := os.Stat(path)
-	if err != nil {
-		fmt.Println("3")
-		return err
-	}
-
-	if info.IsDir() {
-		dirEntries, err := file.Readdir(0)
-		if err != nil {
-			return err
-		}
-		file.Close()
-
-		for _, dirEntry := range dirEntries {
-			dirEntryPath := filepath.Join(path, dirEntry.Name())
-			command.buildFileSystemMapRecursive(dirEntryPath, pathsBySize)
-		}
-	} else {
-		file.Close()
-
-		if info.Size() > 0 {
-			paths, found := pathsBySize[info.Size()]
-			if !found {
-				paths = make([]string, 0, 10)
-			}
-			paths = append(paths, path)
-			pathsBySize[info.Size()] = paths
-		}
-	}
-
-	return nil
+	return nil, nil
 }
\ No newline at end of file
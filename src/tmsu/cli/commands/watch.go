@@ -0,0 +1,440 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+	"tmsu/cli"
+	"tmsu/fingerprint/cache"
+	"tmsu/fs"
+	"tmsu/log"
+	"tmsu/storage"
+	"tmsu/storage/database"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// debounceInterval is how long 'watch' waits after the last event seen for
+// a path before acting on it, so that editors which write a file and then
+// rename it into place only cause a single re-fingerprint rather than one
+// per event in the burst.
+const debounceInterval = 500 * time.Millisecond
+
+//TODO watching a remote filesystem (SFTP, S3) is not yet supported: these
+// backends have no equivalent of inotify to drive events from. Exec rejects
+// any filesystem other than the local one outright, rather than letting
+// fsnotify fail confusingly against a remote path string.
+
+//TODO rename/move pairs are correlated by fingerprint alone (see onCreate's
+// use of takeRemoved), never by fsnotify's rename cookie: gopkg.in/fsnotify.v1's
+// Event has no Cookie field to correlate on, on Linux or anywhere else. This
+// is weaker than cookie correlation (it can be fooled by two files of the
+// same size and content swapping names) but is the only signal this watcher
+// has available.
+
+type WatchCommand struct {
+	verbose    bool
+	filesystem fs.Filesystem
+}
+
+func (WatchCommand) Name() cli.CommandName {
+	return "watch"
+}
+
+func (WatchCommand) Synopsis() string {
+	return "Watch tagged directories and keep the database live"
+}
+
+func (WatchCommand) Description() string {
+	return `tmsu watch [PATH]...
+
+Watches tagged directories under PATHs for changes and updates the database
+as they happen, rather than relying on a subsequent 'tmsu repair' to catch
+up.
+
+    * New files created under a tagged directory are added and implicitly
+      tagged, as 'repair' would do.
+    * Modified files have their fingerprint recomputed and the database
+      updated.
+    * Renamed or moved files have their path updated in place rather than
+      being marked missing and re-discovered as a new file.
+    * Deleted files are marked missing.
+
+Where no PATHS are specified, every tagged directory in the database is
+watched. 'watch' runs until interrupted.`
+}
+
+func (WatchCommand) Options() cli.Options {
+	return cli.Options{}
+}
+
+func (command WatchCommand) Exec(options cli.Options, args []string) error {
+	command.verbose = cli.HasOption(options, "--verbose")
+
+	store, err := storage.Open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	registry, err := fs.OpenPathRegistry(filepath.Join(store.Db.Dir(), registryPath))
+	if err != nil {
+		return err
+	}
+
+	filesystem, args, err := resolveFilesystem(registry, args)
+	if err != nil {
+		return err
+	}
+	if filesystem.Type() != (fs.Basic{}).Type() {
+		return fmt.Errorf("watch does not support the '%v' filesystem: fsnotify has no remote equivalent, only the local filesystem can be watched", filesystem.Type())
+	}
+	command.filesystem = filesystem
+
+	fingerprints, err := cache.Open(command.filesystem, filepath.Join(store.Db.Dir(), cachePath))
+	if err != nil {
+		return err
+	}
+	defer fingerprints.Close()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	w := &watch{
+		command:              command,
+		store:                store,
+		fingerprints:         fingerprints,
+		watcher:              watcher,
+		pending:              make(map[string]*time.Timer),
+		removedByFingerprint: make(map[string]removedFile),
+		watchedDirs:          make(map[string]bool),
+	}
+
+	dirs, err := w.taggedDirectories(args)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := w.watchTree(dir); err != nil {
+			return err
+		}
+	}
+
+	if command.verbose {
+		fmt.Printf("watching %v director(y/ies).\n", len(dirs))
+	}
+
+	return w.run()
+}
+
+// removedFile is a file 'watch' has seen disappear, kept around for a short
+// while so that a subsequent CREATE with a matching fingerprint can be
+// recognised as the other half of a move rather than an unrelated new file.
+type removedFile struct {
+	id   database.FileId
+	path string
+	size int64
+}
+
+// watch holds the live state for a single 'tmsu watch' run.
+type watch struct {
+	command      WatchCommand
+	store        *storage.Storage
+	fingerprints *cache.Cache
+	watcher      *fsnotify.Watcher
+
+	mutex                sync.Mutex
+	pending              map[string]*time.Timer
+	removedByFingerprint map[string]removedFile
+	watchedDirs          map[string]bool
+}
+
+// taggedDirectories returns every tagged directory under args, or every
+// tagged directory in the database if args is empty.
+func (w *watch) taggedDirectories(args []string) ([]string, error) {
+	var entries database.Files
+
+	if len(args) == 0 {
+		allEntries, err := w.store.Files()
+		if err != nil {
+			return nil, err
+		}
+		entries = allEntries
+	} else {
+		for _, root := range args {
+			absRoot, err := w.command.filesystem.Abs(root)
+			if err != nil {
+				return nil, err
+			}
+
+			rootEntries, err := w.store.FilesByDirectory(absRoot)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, rootEntries...)
+		}
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		info, err := w.command.filesystem.Stat(entry.Path())
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			dirs = append(dirs, entry.Path())
+		}
+	}
+
+	return dirs, nil
+}
+
+// watchTree adds a watch on dir and, recursively, on every subdirectory
+// beneath it so that new and removed subdirectories are picked up too.
+func (w *watch) watchTree(dir string) error {
+	if err := w.watcher.Add(dir); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	w.watchedDirs[dir] = true
+	w.mutex.Unlock()
+
+	infos, err := w.command.filesystem.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			if err := w.watchTree(w.command.filesystem.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// forgetWatch removes the fsnotify watch on path, if one was added by
+// watchTree, so that watches do not accumulate for directories that have
+// been deleted or renamed away. It is a no-op, rather than an error, for a
+// path that was never watched (i.e. a plain file).
+func (w *watch) forgetWatch(path string) {
+	w.mutex.Lock()
+	watched := w.watchedDirs[path]
+	delete(w.watchedDirs, path)
+	w.mutex.Unlock()
+
+	if watched {
+		// best effort: the directory is already gone, so there is nothing
+		// to do if the watcher has already dropped it of its own accord.
+		w.watcher.Remove(path)
+	}
+}
+
+// run drives the event loop until the watcher is closed or an
+// unrecoverable error is seen.
+func (w *watch) run() error {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			if err := w.handle(event); err != nil {
+				log.Warnf("'%v': %v", event.Name, err)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warnf("watch: %v", err)
+		}
+	}
+}
+
+func (w *watch) handle(event fsnotify.Event) error {
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		return w.debounce(event.Name, w.onCreate)
+	case event.Op&(fsnotify.Write|fsnotify.Chmod) != 0:
+		return w.debounce(event.Name, w.onModify)
+	case event.Op&fsnotify.Rename == fsnotify.Rename:
+		return w.debounce(event.Name, w.onRemove)
+	case event.Op&fsnotify.Remove == fsnotify.Remove:
+		return w.debounce(event.Name, w.onRemove)
+	}
+
+	return nil
+}
+
+// debounce delays running action for path until debounceInterval has
+// elapsed without a further event for the same path, collapsing bursts
+// such as an editor's write-then-rename-into-place into a single action.
+func (w *watch) debounce(path string, action func(string) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if timer, found := w.pending[path]; found {
+		timer.Stop()
+	}
+
+	w.pending[path] = time.AfterFunc(debounceInterval, func() {
+		w.mutex.Lock()
+		delete(w.pending, path)
+		w.mutex.Unlock()
+
+		if err := action(path); err != nil {
+			log.Warnf("'%v': %v", path, err)
+		}
+	})
+
+	return nil
+}
+
+func (w *watch) onCreate(path string) error {
+	info, err := w.command.filesystem.Stat(path)
+	if err != nil {
+		// file has already gone again: nothing to do.
+		return nil
+	}
+
+	if info.IsDir() {
+		return w.watchTree(path)
+	}
+
+	fingerprint, err := w.fingerprints.Checksum(path)
+	if err != nil {
+		return err
+	}
+
+	if removed, found := w.takeRemoved(string(fingerprint)); found && removed.size == info.Size() {
+		if w.command.verbose {
+			fmt.Printf("'%v': moved from '%v'.\n", path, removed.path)
+		}
+
+		return w.store.UpdateFile(removed.id, path, fingerprint, info.ModTime().UTC(), info.Size())
+	}
+
+	parent := filepath.Dir(path)
+
+	parentFile, err := w.store.FileByPath(parent)
+	if err != nil || parentFile == nil {
+		return err
+	}
+
+	childFile, err := cli.AddFile(w.store, path)
+	if err != nil {
+		return err
+	}
+
+	tags, err := w.store.TagsByFileId(parentFile.Id, false)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if _, err := w.store.AddImplicitFileTag(childFile.Id, tag.Id); err != nil {
+			return err
+		}
+	}
+
+	if w.command.verbose {
+		fmt.Printf("'%v': new.\n", path)
+	}
+
+	return nil
+}
+
+func (w *watch) onModify(path string) error {
+	info, err := w.command.filesystem.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	file, err := w.store.FileByPath(path)
+	if err != nil || file == nil {
+		return err
+	}
+
+	if err := w.fingerprints.Invalidate(path); err != nil {
+		return err
+	}
+
+	fingerprint, err := w.fingerprints.Checksum(path)
+	if err != nil {
+		return err
+	}
+
+	if w.command.verbose {
+		fmt.Printf("'%v': modified.\n", path)
+	}
+
+	return w.store.UpdateFile(file.Id, path, fingerprint, info.ModTime().UTC(), info.Size())
+}
+
+func (w *watch) onRemove(path string) error {
+	w.forgetWatch(path)
+
+	file, err := w.store.FileByPath(path)
+	if err != nil || file == nil {
+		return err
+	}
+
+	// the cached checksum for path must not outlive the file it was
+	// computed for: without this, a new file later created at the same
+	// path with a coincidentally matching size and modification time
+	// would be handed this stale checksum by onCreate instead of having
+	// its own content hashed.
+	if err := w.fingerprints.Invalidate(path); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	w.removedByFingerprint[string(file.Fingerprint)] = removedFile{id: file.Id, path: path, size: file.Size}
+	w.mutex.Unlock()
+
+	// left as-is in the database: if this turns out to be one half of a
+	// move then onCreate will update the path in place once the other
+	// half arrives; otherwise a later 'repair' will find it missing, same
+	// as it always has.
+	log.Warnf("'%v': missing.", path)
+
+	return nil
+}
+
+func (w *watch) takeRemoved(fingerprint string) (removedFile, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	removed, found := w.removedByFingerprint[fingerprint]
+	if found {
+		delete(w.removedByFingerprint, fingerprint)
+	}
+
+	return removed, found
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"testing"
+	"tmsu/storage/database"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+func newTestWatch(t *testing.T) *watch {
+	t.Helper()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Skipf("fsnotify.NewWatcher: %v", err)
+	}
+	t.Cleanup(func() { watcher.Close() })
+
+	return &watch{
+		watcher:              watcher,
+		removedByFingerprint: make(map[string]removedFile),
+		watchedDirs:          make(map[string]bool),
+	}
+}
+
+func TestTakeRemovedFindsAndConsumesAMatch(t *testing.T) {
+	w := newTestWatch(t)
+	w.removedByFingerprint["abc123"] = removedFile{id: database.FileId(1), path: "/old/path", size: 10}
+
+	removed, found := w.takeRemoved("abc123")
+	if !found {
+		t.Fatalf("takeRemoved did not find a recorded removal")
+	}
+	if removed.path != "/old/path" || removed.size != 10 {
+		t.Fatalf("takeRemoved returned %+v, want path=/old/path size=10", removed)
+	}
+
+	if _, found := w.takeRemoved("abc123"); found {
+		t.Fatalf("takeRemoved returned the same removal twice")
+	}
+}
+
+func TestTakeRemovedMissingFingerprint(t *testing.T) {
+	w := newTestWatch(t)
+
+	if _, found := w.takeRemoved("does-not-exist"); found {
+		t.Fatalf("takeRemoved found a removal that was never recorded")
+	}
+}
+
+func TestForgetWatchRemovesOnlyKnownWatches(t *testing.T) {
+	dir := t.TempDir()
+
+	w := newTestWatch(t)
+	if err := w.watcher.Add(dir); err != nil {
+		t.Skipf("watcher.Add: %v", err)
+	}
+	w.watchedDirs[dir] = true
+
+	w.forgetWatch(dir)
+
+	if w.watchedDirs[dir] {
+		t.Fatalf("forgetWatch left %v in watchedDirs", dir)
+	}
+
+	// a path that was never watched (e.g. a plain file) must be a no-op,
+	// not an error.
+	w.forgetWatch("/never/watched")
+}
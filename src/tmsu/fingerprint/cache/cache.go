@@ -0,0 +1,365 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package cache maintains a persistent, on-disk index of file and directory
+// digests so that repeated scans of a tagged tree (by 'repair' and 'watch')
+// do not have to re-read and re-hash files whose size and
+// modification time have not changed since they were last seen.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"tmsu/fingerprint"
+	"tmsu/fs"
+
+	"github.com/boltdb/bolt"
+)
+
+// entryKind distinguishes the two kinds of entry stored under a directory
+// path: the directory's own "header" digest (name, mode and entry list) and
+// the digest of its contents taken recursively.
+type entryKind byte
+
+const (
+	kindFile entryKind = iota
+	kindDirHeader
+	kindDirRecursive
+)
+
+var bucketName = []byte("fingerprints")
+
+// entry is the value stored against a path (and kind) in the cache.
+type entry struct {
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+}
+
+// Cache is a persistent, path-keyed store of file and directory digests,
+// backed by an immutable radix tree that is rebuilt in memory on Open from a
+// bolt database; every entry stored or invalidated is also written through
+// to that database at once. The radix tree gives cheap prefix
+// invalidation: touching a leaf invalidates every ancestor's recursive
+// digest up to the tree root without needing to know the ancestors' sizes
+// or modification times.
+type Cache struct {
+	mutex      sync.Mutex
+	db         *bolt.DB
+	tree       *node
+	filesystem fs.Filesystem
+}
+
+// Open loads the cache from the bolt database at dbPath, creating it if it
+// does not already exist. Digests for paths passed to Checksum and
+// ChecksumTree are computed by reading through filesystem, so the same
+// cache implementation serves the local filesystem, SFTP and S3 backends
+// alike.
+func Open(filesystem fs.Filesystem, dbPath string) (*Cache, error) {
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	tree := newNode()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(key, value []byte) error {
+			cleanPath, kind := decodeKey(key)
+			e, err := decodeEntry(value)
+			if err != nil {
+				return err
+			}
+
+			tree = tree.insert(cleanPath, kind, e)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Cache{db: db, tree: tree, filesystem: filesystem}, nil
+}
+
+// Close releases the underlying database. Every change has already been
+// written to it as it was made, so there is nothing left to flush.
+func (cache *Cache) Close() error {
+	return cache.db.Close()
+}
+
+// Checksum returns the cached checksum for the file at path if its size and
+// modification time still match what was last recorded, recomputing and
+// storing it otherwise.
+func (cache *Cache) Checksum(path string) (fingerprint.Fingerprint, error) {
+	cleanPath, err := cache.cleanAbs(path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := cache.filesystem.Stat(cleanPath)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mutex.Lock()
+	cached, found := cache.tree.lookup(cleanPath, kindFile)
+	cache.mutex.Unlock()
+
+	if found && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime().UTC()) {
+		return fingerprint.Fingerprint(cached.Checksum), nil
+	}
+
+	sum, err := cache.hash(cleanPath)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cache.store(cleanPath, kindFile, entry{info.Size(), info.ModTime().UTC(), string(sum)}); err != nil {
+		return "", err
+	}
+
+	return sum, nil
+}
+
+// hash streams the file at path through filesystem and returns its SHA-256
+// digest, so that the same logic hashes a local file, an SFTP file or an S3
+// object without having to pull the whole file into memory first.
+func (cache *Cache) hash(path string) (fingerprint.Fingerprint, error) {
+	reader, err := cache.filesystem.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, reader); err != nil {
+		return "", err
+	}
+
+	return fingerprint.Fingerprint(hex.EncodeToString(digest.Sum(nil))), nil
+}
+
+// ChecksumTree returns a digest of the recursive contents of the directory
+// at path, reusing cached subtree digests wherever nothing beneath them has
+// changed. The second return value reports whether the cached recursive
+// digest was reused as-is: callers such as 'repair' use this to skip the
+// expensive walk they would otherwise do beneath path to look for new files
+// and missing implicit taggings, since nothing there can have changed.
+//
+// The short-circuit is only as sound as its one-level check below path: a
+// directory's own header and modification time change when an entry is
+// added, removed or renamed, but not when an existing file's content
+// changes in place, so ChecksumTree also re-stats each immediate child and
+// compares it against what was cached for it before trusting the rollup.
+// This catches a content change to a direct child, but a change two or more
+// levels down (e.g. a grandchild's content edited without that grandchild's
+// immediate parent's own mtime or entry list changing) is only caught if
+// something along the way called Invalidate for the changed path, which
+// walks every ancestor's cached recursive digest out. 'repair' happens to
+// get this for free from its own independent, separate scan of every
+// database entry; a caller driving ChecksumTree on its own (as 'status' or
+// 'tag' might) must make the same guarantee itself.
+func (cache *Cache) ChecksumTree(path string) (fingerprint.Fingerprint, bool, error) {
+	cleanPath, err := cache.cleanAbs(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	info, err := cache.filesystem.Stat(cleanPath)
+	if err != nil {
+		return "", false, err
+	}
+	if !info.IsDir() {
+		sum, err := cache.Checksum(cleanPath)
+		return sum, false, err
+	}
+
+	cache.mutex.Lock()
+	cached, found := cache.tree.lookup(cleanPath, kindDirRecursive)
+	cache.mutex.Unlock()
+
+	names, err := cache.readdirnames(cleanPath)
+	if err != nil {
+		return "", false, err
+	}
+
+	header := cache.dirHeader(cleanPath, info, names)
+
+	if found && cached.Checksum != "" {
+		cachedHeader, headerFound := cache.tree.lookup(cleanPath, kindDirHeader)
+		if headerFound && cachedHeader.Checksum == header && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime().UTC()) {
+			unchanged, err := cache.childrenUnchanged(cleanPath, names)
+			if err != nil {
+				return "", false, err
+			}
+			if unchanged {
+				return fingerprint.Fingerprint(cached.Checksum), true, nil
+			}
+		}
+	}
+
+	digest := sha256.New()
+	digest.Write([]byte(header))
+
+	for _, name := range names {
+		childSum, _, err := cache.ChecksumTree(cache.filesystem.Join(cleanPath, name))
+		if err != nil {
+			return "", false, err
+		}
+		digest.Write([]byte(childSum))
+	}
+
+	sum := fingerprint.Fingerprint(hex.EncodeToString(digest.Sum(nil)))
+
+	if err := cache.store(cleanPath, kindDirHeader, entry{0, time.Time{}, header}); err != nil {
+		return "", false, err
+	}
+	if err := cache.store(cleanPath, kindDirRecursive, entry{info.Size(), info.ModTime().UTC(), string(sum)}); err != nil {
+		return "", false, err
+	}
+
+	return sum, false, nil
+}
+
+// Invalidate discards the cached file digest for path and the cached
+// recursive digest of every ancestor directory up to the tree root, forcing
+// them to be recomputed the next time they are requested. 'repair' and
+// 'watch' call it before re-fingerprinting a file whose size or modification
+// time has changed, and 'watch' also calls it when a file is removed;
+// recording a moved file's new path in the database does not call it.
+func (cache *Cache) Invalidate(path string) error {
+	cleanPath, err := cache.cleanAbs(path)
+	if err != nil {
+		return err
+	}
+
+	cache.mutex.Lock()
+	cache.tree = cache.tree.remove(cleanPath, kindFile)
+	cache.mutex.Unlock()
+
+	for dir := filepath.Dir(cleanPath); ; dir = filepath.Dir(dir) {
+		cache.mutex.Lock()
+		cache.tree = cache.tree.remove(dir, kindDirRecursive)
+		cache.mutex.Unlock()
+
+		if err := cache.deleteFromDisk(dir, kindDirRecursive); err != nil {
+			return err
+		}
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	return cache.deleteFromDisk(cleanPath, kindFile)
+}
+
+func (cache *Cache) store(path string, kind entryKind, e entry) error {
+	cache.mutex.Lock()
+	cache.tree = cache.tree.insert(path, kind, e)
+	cache.mutex.Unlock()
+
+	return cache.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		return bucket.Put(encodeKey(path, kind), encodeEntry(e))
+	})
+}
+
+func (cache *Cache) deleteFromDisk(path string, kind entryKind) error {
+	return cache.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		return bucket.Delete(encodeKey(path, kind))
+	})
+}
+
+// childrenUnchanged reports whether every immediate child named in names
+// still has the size and modification time last recorded for it, without
+// recursing any further. A directory's own header and mtime alone only
+// detect entries being added, removed or renamed; they say nothing about a
+// child file's content having changed in place, which is exactly the case
+// this check exists to catch before ChecksumTree trusts a cached recursive
+// digest for the parent.
+func (cache *Cache) childrenUnchanged(dir string, names []string) (bool, error) {
+	for _, name := range names {
+		childPath := cache.filesystem.Join(dir, name)
+
+		info, err := cache.filesystem.Stat(childPath)
+		if err != nil {
+			return false, err
+		}
+
+		kind := kindFile
+		if info.IsDir() {
+			kind = kindDirRecursive
+		}
+
+		cache.mutex.Lock()
+		cached, found := cache.tree.lookup(childPath, kind)
+		cache.mutex.Unlock()
+
+		if !found || cached.Size != info.Size() || !cached.ModTime.Equal(info.ModTime().UTC()) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func unixNanoUTC(nanos int64) time.Time {
+	return time.Unix(0, nanos).UTC()
+}
+
+func (cache *Cache) cleanAbs(path string) (string, error) {
+	return cache.filesystem.Abs(path)
+}
+
+func (cache *Cache) readdirnames(path string) ([]string, error) {
+	infos, err := cache.filesystem.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names, nil
+}
+
+func (cache *Cache) dirHeader(path string, info os.FileInfo, names []string) string {
+	digest := sha256.New()
+	digest.Write([]byte(filepath.Base(path)))
+	digest.Write([]byte(info.Mode().String()))
+	for _, name := range names {
+		digest.Write([]byte(name))
+	}
+
+	return hex.EncodeToString(digest.Sum(nil))
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tmsu/fs"
+)
+
+func openTestCache(t *testing.T) *Cache {
+	t.Helper()
+
+	cache, err := Open(fs.Basic{}, filepath.Join(t.TempDir(), "fingerprints.cache"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+
+	return cache
+}
+
+func TestChecksumIsMemoized(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cache := openTestCache(t)
+
+	sum, err := cache.Checksum(path)
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+
+	// change the content without touching size or modification time: a
+	// real filesystem could never do this, so a cache that is actually
+	// consulting size/mtime (rather than re-hashing every time) must still
+	// return the now-stale, memoized digest.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("howdy"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	again, err := cache.Checksum(path)
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+	if again != sum {
+		t.Fatalf("Checksum changed despite unchanged size/mtime: got %v, want memoized %v", again, sum)
+	}
+}
+
+func TestChecksumRecomputesAfterModification(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cache := openTestCache(t)
+
+	sum, err := cache.Checksum(path)
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("a different, longer body"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	again, err := cache.Checksum(path)
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+	if again == sum {
+		t.Fatalf("Checksum did not change after the file's size changed")
+	}
+}
+
+func TestInvalidateForcesRecompute(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cache := openTestCache(t)
+
+	sum, err := cache.Checksum(path)
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("howdy"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	if err := cache.Invalidate(path); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+
+	again, err := cache.Checksum(path)
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+	if again == sum {
+		t.Fatalf("Checksum still memoized after Invalidate")
+	}
+}
+
+func TestChecksumTreeReusesUnchangedSubtree(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cache := openTestCache(t)
+
+	first, unchanged, err := cache.ChecksumTree(dir)
+	if err != nil {
+		t.Fatalf("ChecksumTree: %v", err)
+	}
+	if unchanged {
+		t.Fatalf("first ChecksumTree of an uncached directory reported unchanged")
+	}
+
+	second, unchanged, err := cache.ChecksumTree(dir)
+	if err != nil {
+		t.Fatalf("ChecksumTree: %v", err)
+	}
+	if !unchanged {
+		t.Fatalf("second ChecksumTree of an untouched directory did not reuse the cached digest")
+	}
+	if second != first {
+		t.Fatalf("ChecksumTree digest changed across calls to an untouched directory")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "b"), []byte("b"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	third, unchanged, err := cache.ChecksumTree(dir)
+	if err != nil {
+		t.Fatalf("ChecksumTree: %v", err)
+	}
+	if unchanged {
+		t.Fatalf("ChecksumTree reported unchanged after a new file was added to the directory")
+	}
+	if third == first {
+		t.Fatalf("ChecksumTree digest did not change after a new file was added to the directory")
+	}
+}
+
+func TestChecksumTreeDetectsChildContentChange(t *testing.T) {
+	dir := t.TempDir()
+	child := filepath.Join(dir, "a")
+	if err := os.WriteFile(child, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cache := openTestCache(t)
+
+	first, _, err := cache.ChecksumTree(dir)
+	if err != nil {
+		t.Fatalf("ChecksumTree: %v", err)
+	}
+
+	// same name, same size, but different content and a distinct mtime:
+	// the directory's own header (names) and mtime are untouched, so only
+	// checking the child's own stat info catches this.
+	info, err := os.Stat(child)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := os.WriteFile(child, []byte("howdy"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(child, info.ModTime().Add(time.Second), info.ModTime().Add(time.Second)); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	second, unchanged, err := cache.ChecksumTree(dir)
+	if err != nil {
+		t.Fatalf("ChecksumTree: %v", err)
+	}
+	if unchanged {
+		t.Fatalf("ChecksumTree reused the cached digest despite a child's content changing")
+	}
+	if second == first {
+		t.Fatalf("ChecksumTree digest did not change after a child's content changed")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+)
+
+// node is one node of the in-memory radix tree keyed on cleaned, slash
+// separated path segments. The tree is immutable: insert and remove return
+// a new root rather than mutating the receiver, so a lookup racing with a
+// concurrent update always sees a consistent snapshot.
+type node struct {
+	children map[string]*node
+	entries  map[entryKind]entry
+	present  map[entryKind]bool
+}
+
+func newNode() *node {
+	return &node{
+		children: make(map[string]*node),
+		entries:  make(map[entryKind]entry),
+		present:  make(map[entryKind]bool),
+	}
+}
+
+func (n *node) clone() *node {
+	c := newNode()
+	for k, v := range n.children {
+		c.children[k] = v
+	}
+	for k, v := range n.entries {
+		c.entries[k] = v
+	}
+	for k, v := range n.present {
+		c.present[k] = v
+	}
+	return c
+}
+
+func segments(path string) []string {
+	clean := filepath.Clean(path)
+	return strings.Split(strings.Trim(clean, string(filepath.Separator)), string(filepath.Separator))
+}
+
+func (n *node) insert(path string, kind entryKind, e entry) *node {
+	return n.insertSegments(segments(path), kind, e)
+}
+
+func (n *node) insertSegments(segs []string, kind entryKind, e entry) *node {
+	root := n.clone()
+
+	if len(segs) == 0 {
+		root.entries[kind] = e
+		root.present[kind] = true
+		return root
+	}
+
+	head, rest := segs[0], segs[1:]
+	child, found := root.children[head]
+	if !found {
+		child = newNode()
+	}
+	root.children[head] = child.insertSegments(rest, kind, e)
+
+	return root
+}
+
+func (n *node) lookup(path string, kind entryKind) (entry, bool) {
+	cur := n
+	for _, seg := range segments(path) {
+		child, found := cur.children[seg]
+		if !found {
+			return entry{}, false
+		}
+		cur = child
+	}
+
+	e, found := cur.present[kind]
+	if !found || !e {
+		return entry{}, false
+	}
+
+	return cur.entries[kind], true
+}
+
+func (n *node) remove(path string, kind entryKind) *node {
+	return n.removeSegments(segments(path), kind)
+}
+
+func (n *node) removeSegments(segs []string, kind entryKind) *node {
+	root := n.clone()
+
+	if len(segs) == 0 {
+		delete(root.entries, kind)
+		delete(root.present, kind)
+		return root
+	}
+
+	head, rest := segs[0], segs[1:]
+	child, found := root.children[head]
+	if !found {
+		return root
+	}
+	root.children[head] = child.removeSegments(rest, kind)
+
+	return root
+}
+
+func encodeKey(path string, kind entryKind) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(byte(kind))
+	buf.WriteString(path)
+	return buf.Bytes()
+}
+
+func decodeKey(key []byte) (string, entryKind) {
+	return string(key[1:]), entryKind(key[0])
+}
+
+func encodeEntry(e entry) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	binary.Write(buf, binary.BigEndian, e.Size)
+	binary.Write(buf, binary.BigEndian, e.ModTime.UnixNano())
+
+	buf.WriteString(e.Checksum)
+
+	return buf.Bytes()
+}
+
+func decodeEntry(data []byte) (entry, error) {
+	buf := bytes.NewReader(data)
+
+	var size int64
+	var nanos int64
+
+	if err := binary.Read(buf, binary.BigEndian, &size); err != nil {
+		return entry{}, err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &nanos); err != nil {
+		return entry{}, err
+	}
+
+	checksum := make([]byte, buf.Len())
+	buf.Read(checksum)
+
+	return entry{Size: size, ModTime: unixNanoUTC(nanos), Checksum: string(checksum)}, nil
+}
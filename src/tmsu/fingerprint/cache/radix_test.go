@@ -0,0 +1,122 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeInsertLookup(t *testing.T) {
+	root := newNode()
+
+	want := entry{Size: 123, ModTime: time.Unix(0, 0).UTC(), Checksum: "abc"}
+	root = root.insert("/a/b/c", kindFile, want)
+
+	got, found := root.lookup("/a/b/c", kindFile)
+	if !found {
+		t.Fatalf("lookup did not find inserted entry")
+	}
+	if got != want {
+		t.Fatalf("lookup returned %+v, want %+v", got, want)
+	}
+}
+
+func TestNodeLookupMissing(t *testing.T) {
+	root := newNode()
+
+	if _, found := root.lookup("/a/b/c", kindFile); found {
+		t.Fatalf("lookup found an entry in an empty tree")
+	}
+
+	root = root.insert("/a/b/c", kindFile, entry{Size: 1})
+
+	if _, found := root.lookup("/a/b/c", kindDirHeader); found {
+		t.Fatalf("lookup found an entry under the wrong kind")
+	}
+	if _, found := root.lookup("/a/b/x", kindFile); found {
+		t.Fatalf("lookup found an entry under an unrelated path")
+	}
+}
+
+func TestNodeInsertIsImmutable(t *testing.T) {
+	before := newNode()
+	before = before.insert("/a", kindFile, entry{Size: 1})
+
+	after := before.insert("/a", kindFile, entry{Size: 2})
+
+	gotBefore, _ := before.lookup("/a", kindFile)
+	if gotBefore.Size != 1 {
+		t.Fatalf("insert on a new root mutated the original: got size %v, want 1", gotBefore.Size)
+	}
+
+	gotAfter, _ := after.lookup("/a", kindFile)
+	if gotAfter.Size != 2 {
+		t.Fatalf("new root missing the update: got size %v, want 2", gotAfter.Size)
+	}
+}
+
+func TestNodeRemove(t *testing.T) {
+	root := newNode()
+	root = root.insert("/a/b", kindFile, entry{Size: 1})
+	root = root.insert("/a/b", kindDirHeader, entry{Checksum: "h"})
+
+	removed := root.remove("/a/b", kindFile)
+
+	if _, found := removed.lookup("/a/b", kindFile); found {
+		t.Fatalf("removed kind still found after remove")
+	}
+	if _, found := removed.lookup("/a/b", kindDirHeader); !found {
+		t.Fatalf("remove of one kind discarded an unrelated kind at the same path")
+	}
+	if _, found := root.lookup("/a/b", kindFile); !found {
+		t.Fatalf("remove on a new root mutated the original")
+	}
+}
+
+func TestNodeRemoveMissingPathIsNoop(t *testing.T) {
+	root := newNode()
+	root = root.insert("/a", kindFile, entry{Size: 1})
+
+	removed := root.remove("/does/not/exist", kindFile)
+
+	if _, found := removed.lookup("/a", kindFile); !found {
+		t.Fatalf("remove of an unrelated path discarded an existing entry")
+	}
+}
+
+func TestEncodeDecodeKey(t *testing.T) {
+	key := encodeKey("/a/b/c", kindDirRecursive)
+
+	path, kind := decodeKey(key)
+	if path != "/a/b/c" || kind != kindDirRecursive {
+		t.Fatalf("decodeKey(encodeKey(...)) = (%q, %v), want (\"/a/b/c\", %v)", path, kind, kindDirRecursive)
+	}
+}
+
+func TestEncodeDecodeEntry(t *testing.T) {
+	want := entry{Size: 456, ModTime: time.Unix(1700000000, 0).UTC(), Checksum: "deadbeef"}
+
+	got, err := decodeEntry(encodeEntry(want))
+	if err != nil {
+		t.Fatalf("decodeEntry: %v", err)
+	}
+	if got != want {
+		t.Fatalf("decodeEntry(encodeEntry(...)) = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Basic is the default Filesystem, wrapping the local POSIX filesystem via
+// the os and path/filepath packages. It is the backend used whenever a
+// path is given without a URI scheme.
+type Basic struct{}
+
+func (Basic) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (Basic) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (Basic) ReadDir(path string) ([]os.FileInfo, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	return dir.Readdir(0)
+}
+
+func (Basic) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (Basic) Abs(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Clean(absPath), nil
+}
+
+func (Basic) URI(path string) string {
+	return path
+}
+
+func (Basic) Type() string {
+	return "basic"
+}
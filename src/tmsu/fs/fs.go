@@ -0,0 +1,61 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package fs abstracts the filesystem that tagged files live on so that
+// commands such as 'repair' and 'tag' can work identically whether a path
+// refers to the local POSIX filesystem, a remote SFTP server or an
+// S3-style object store.
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// Filesystem is implemented by each supported storage backend. A path
+// passed to any method is always backend-relative: the URI scheme and host
+// have already been stripped off by New.
+type Filesystem interface {
+	// Stat returns file info for path, as os.Stat does for the local
+	// filesystem.
+	Stat(path string) (os.FileInfo, error)
+
+	// Open opens path for reading. Fingerprints are computed by streaming
+	// through the returned reader so that a remote backend need not pull
+	// the whole file into memory first.
+	Open(path string) (io.ReadCloser, error)
+
+	// ReadDir lists the immediate children of the directory at path.
+	ReadDir(path string) ([]os.FileInfo, error)
+
+	// Join joins path elements using the backend's separator.
+	Join(elem ...string) string
+
+	// Abs returns the absolute, cleaned form of path on this backend.
+	Abs(path string) (string, error)
+
+	// URI returns the canonical URI for path on this backend, e.g.
+	// "sftp://host/some/path".
+	URI(path string) string
+
+	// Type identifies the backend, e.g. "basic", "sftp" or "s3". A
+	// PathRegistry records it, with the URI, against each path given to
+	// 'repair' or 'watch' so that the backend can be reconstructed on a
+	// later run without the caller having to specify the URI again. Neither
+	// is stored on a database.File.
+	Type() string
+}
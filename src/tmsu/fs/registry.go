@@ -0,0 +1,136 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// New resolves uriOrPath to a Filesystem and the backend-relative path
+// within it. A plain path with no "scheme://" prefix resolves to the Basic
+// (local) filesystem. Recognised schemes are "sftp" and "s3".
+func New(uriOrPath string) (Filesystem, string, error) {
+	scheme, rest, found := strings.Cut(uriOrPath, "://")
+	if !found {
+		return Basic{}, uriOrPath, nil
+	}
+
+	switch scheme {
+	case "sftp":
+		host, path, _ := strings.Cut(rest, "/")
+		filesystem, err := NewSFTP(host)
+		if err != nil {
+			return nil, "", err
+		}
+		return filesystem, "/" + path, nil
+	case "s3":
+		bucket, key, _ := strings.Cut(rest, "/")
+		filesystem, err := NewS3(bucket)
+		if err != nil {
+			return nil, "", err
+		}
+		return filesystem, key, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported filesystem scheme '%v'", scheme)
+	}
+}
+
+// ForType reconstructs a Filesystem from a backend type and URI as recorded
+// by a PathRegistry.
+func ForType(filesystemType, uri string) (Filesystem, string, error) {
+	switch filesystemType {
+	case "", "basic":
+		return Basic{}, uri, nil
+	default:
+		return New(uri)
+	}
+}
+
+// pathRecord is the backend a PATH argument resolved to on a previous run,
+// keyed by the backend-relative path the argument resolved to.
+type pathRecord struct {
+	Type string `json:"type"`
+	URI  string `json:"uri"`
+}
+
+// PathRegistry remembers, on disk, which Filesystem backend each tagged
+// path was last repaired or watched against, keyed by the backend-relative
+// path (the same form a database.File's path takes). It lets a bare path
+// given to a later run be resolved back to the SFTP or S3 backend it was
+// previously tagged and repaired against, without the caller having to give
+// the full URI again. The backend is recorded per PATH argument, not per
+// file: database.File carries no filesystem type or URI.
+type PathRegistry struct {
+	path    string
+	records map[string]pathRecord
+}
+
+// OpenPathRegistry loads the registry from path, which need not yet exist.
+func OpenPathRegistry(path string) (*PathRegistry, error) {
+	records := make(map[string]pathRecord)
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	case os.IsNotExist(err):
+	default:
+		return nil, err
+	}
+
+	return &PathRegistry{path: path, records: records}, nil
+}
+
+// Lookup returns the Filesystem previously recorded for relPath, if any.
+func (registry *PathRegistry) Lookup(relPath string) (Filesystem, string, bool, error) {
+	record, found := registry.records[relPath]
+	if !found {
+		return nil, "", false, nil
+	}
+
+	filesystem, resolvedPath, err := ForType(record.Type, record.URI)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	return filesystem, resolvedPath, true, nil
+}
+
+// Record persists filesystem as the backend relPath resolved to, so a later
+// run given the same bare path recovers it via Lookup. Nothing is recorded
+// for the Basic filesystem: a bare local path always resolves to it by
+// default, so there is nothing to remember.
+func (registry *PathRegistry) Record(relPath string, filesystem Filesystem) error {
+	if filesystem.Type() == (Basic{}).Type() {
+		return nil
+	}
+
+	registry.records[relPath] = pathRecord{Type: filesystem.Type(), URI: filesystem.URI(relPath)}
+
+	data, err := json.Marshal(registry.records)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(registry.path, data, 0644)
+}
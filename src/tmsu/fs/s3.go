@@ -0,0 +1,147 @@
+/*
+Copyright 2011-2012 Paul Ruane.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3 is a Filesystem backed by an S3-style object store, for paths of the
+// form "s3://bucket/prefix". Directories do not exist as such in S3: one is
+// considered present if any object has its path as a "/"-terminated
+// prefix.
+type S3 struct {
+	bucket string
+	client *s3.S3
+}
+
+// NewS3 returns a Filesystem rooted at the given bucket, using credentials
+// from the environment or the instance's IAM role.
+func NewS3(bucket string) (*S3, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("s3: %v", err)
+	}
+
+	return &S3{bucket: bucket, client: s3.New(sess)}, nil
+}
+
+func (fs *S3) key(p string) string {
+	return strings.TrimPrefix(path.Clean(p), "/")
+}
+
+func (fs *S3) Stat(p string) (os.FileInfo, error) {
+	key := fs.key(p)
+
+	head, err := fs.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(fs.bucket), Key: aws.String(key)})
+	if err == nil {
+		return s3FileInfo{name: path.Base(key), size: aws.Int64Value(head.ContentLength), modTime: aws.TimeValue(head.LastModified)}, nil
+	}
+
+	// no object exists at this exact key: treat it as a directory if any
+	// object has it as a prefix.
+	listing, err := fs.client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(fs.bucket),
+		Prefix:  aws.String(key + "/"),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(listing.Contents) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	return s3FileInfo{name: path.Base(key), isDir: true}, nil
+}
+
+func (fs *S3) Open(p string) (io.ReadCloser, error) {
+	obj, err := fs.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(fs.bucket), Key: aws.String(fs.key(p))})
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.Body, nil
+}
+
+func (fs *S3) ReadDir(dir string) ([]os.FileInfo, error) {
+	prefix := fs.key(dir) + "/"
+
+	var infos []os.FileInfo
+
+	err := fs.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(fs.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, common := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(common.Prefix), prefix), "/")
+			infos = append(infos, s3FileInfo{name: name, isDir: true})
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(obj.Key), prefix)
+			if name == "" {
+				continue
+			}
+			infos = append(infos, s3FileInfo{name: name, size: aws.Int64Value(obj.Size), modTime: aws.TimeValue(obj.LastModified)})
+		}
+		return true
+	})
+
+	return infos, err
+}
+
+func (*S3) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (*S3) Abs(p string) (string, error) {
+	return "/" + strings.TrimPrefix(path.Clean(p), "/"), nil
+}
+
+func (fs *S3) URI(p string) string {
+	return fmt.Sprintf("s3://%v/%v", fs.bucket, fs.key(p))
+}
+
+func (*S3) Type() string {
+	return "s3"
+}
+
+// s3FileInfo adapts an S3 object or common prefix to os.FileInfo.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (i s3FileInfo) Name() string       { return i.name }
+func (i s3FileInfo) Size() int64        { return i.size }
+func (i s3FileInfo) Mode() os.FileMode  { return 0644 }
+func (i s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i s3FileInfo) IsDir() bool        { return i.isDir }
+func (i s3FileInfo) Sys() interface{}   { return nil }